@@ -11,6 +11,7 @@ import (
 	"path"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 )
 
@@ -30,17 +31,20 @@ func RandSeq(n int) string {
 
 // FS represents a btrfs filesystem. Underneath it's a subvolume of a larger filesystem.
 type FS struct {
-	namespace string
+	namespace   string
+	codec       Codec
+	keyProvider KeyProvider
+	cache       *blockCache
 }
 
 // NewFS creates a new filesystem.
 func NewFS(namespace string) *FS {
-	return &FS{namespace}
+	return &FS{namespace: namespace}
 }
 
 // NewFSWithRandSeq creates a new filesystem with a random sequence appended to the end.
 func NewFSWithRandSeq(namespace string) *FS {
-	return &FS{namespace + RandSeq(10)}
+	return &FS{namespace: namespace + RandSeq(10)}
 }
 
 func RunStderr(c *exec.Cmd) error {
@@ -49,14 +53,14 @@ func RunStderr(c *exec.Cmd) error {
 	if err != nil {
 		return err
 	}
-	err = c.Start()
+	ch, err := startChild(c)
 	if err != nil {
 		return err
 	}
 	buf := new(bytes.Buffer)
 	buf.ReadFrom(stderr)
 	log.Println(buf)
-	return c.Wait()
+	return waitChild(c, ch, nil)
 }
 
 func LogErrors(c *exec.Cmd) {
@@ -86,16 +90,14 @@ func (fs *FS) TrimFilePath(name string) string {
 }
 
 func (fs *FS) Create(name string) (*os.File, error) {
-	return os.Create(fs.FilePath(name))
-}
-
-func (fs *FS) CreateFromReader(name string, r io.Reader) (int64, error) {
-	f, err := fs.Create(name)
+	f, err := os.Create(fs.FilePath(name))
 	if err != nil {
-		return 0, err
+		return nil, err
+	}
+	if fs.cache != nil {
+		fs.cache.invalidate(f)
 	}
-	defer f.Close()
-	return io.Copy(f, r)
+	return f, nil
 }
 
 func (fs *FS) Open(name string) (*os.File, error) {
@@ -106,16 +108,13 @@ func (fs *FS) OpenFile(name string, flag int, perm os.FileMode) (*os.File, error
 	return os.OpenFile(fs.FilePath(name), flag, perm)
 }
 
-func (fs *FS) WriteFile(name string, r io.Reader) (int64, error) {
-	f, err := fs.Open(name)
-	if err != nil {
-		return 0, err
-	}
-	defer f.Close()
-	return io.Copy(f, r)
-}
-
 func (fs *FS) Remove(name string) error {
+	if fs.cache != nil {
+		if f, err := fs.Open(name); err == nil {
+			fs.cache.invalidate(f)
+			f.Close()
+		}
+	}
 	return os.Remove(fs.FilePath(name))
 }
 
@@ -198,7 +197,7 @@ func (fs *FS) CallCont(cmd *exec.Cmd, cont func(io.ReadCloser) error) error {
 	if err != nil {
 		return err
 	}
-	err = cmd.Start()
+	ch, err := startChild(cmd)
 	if err != nil {
 		return err
 	}
@@ -211,9 +210,18 @@ func (fs *FS) CallCont(cmd *exec.Cmd, cont func(io.ReadCloser) error) error {
 	buf.ReadFrom(stderr)
 	log.Print("Stderr:", buf)
 
-	return cmd.Wait()
+	return waitChild(cmd, ch, nil)
 }
 
+// SendBase, Send, and Recv operate on whole subvolumes: they shell out to
+// the real `btrfs send`/`btrfs receive` and move its opaque stream
+// byte-for-byte, which is what's required to replicate a commit's actual
+// btrfs metadata (extents, clone sources, ...), not just the logical bytes
+// of the files inside it. SendDedup/RecvDedup (chunks.go) operate one
+// level up, at individual content-addressed files within a subvolume, and
+// dedup by diffing manifests first -- a different unit of transfer that
+// can't be spliced into the `btrfs send` stream these wrap, since that
+// stream isn't aware of the chunk store at all.
 func (fs *FS) SendBase(to string, cont func(io.ReadCloser) error) error {
 	cmd := exec.Command("btrfs", "send", fs.FilePath(to))
 	return fs.CallCont(cmd, cont)
@@ -235,7 +243,7 @@ func (fs *FS) Recv(volume string, data io.ReadCloser) error {
 	if err != nil {
 		return err
 	}
-	err = cmd.Start()
+	ch, err := startChild(cmd)
 	if err != nil {
 		return err
 	}
@@ -253,7 +261,18 @@ func (fs *FS) Recv(volume string, data io.ReadCloser) error {
 	buf.ReadFrom(stderr)
 	log.Print("Stderr:", buf)
 
-	return cmd.Wait()
+	// If `btrfs receive` dies mid-stream -- worker panic, OOM kill, etc --
+	// it can leave volume behind half-written and holding a lock that wedges
+	// every future operation on this namespace. Best-effort clean it up
+	// rather than leaving it for a human to notice the pod is stuck.
+	return waitChild(cmd, ch, func(pid int, ws syscall.WaitStatus) {
+		if ws.Exited() && ws.ExitStatus() == 0 {
+			return
+		}
+		if err := fs.SubvolumeDelete(volume); err != nil {
+			log.Println("btrfs: failed to clean up subvolume after aborted receive of", volume, ":", err)
+		}
+	})
 }
 
 func (fs *FS) Init(repo string) error {
@@ -274,7 +293,17 @@ func (fs *FS) Init(repo string) error {
 
 func (fs *FS) Commit(repo, branch string) (string, error) {
 	commit := branch + "-" + time.Now().Format("2006-01-02T15:04:05.999999-07:00")
-	return commit, fs.Snapshot(path.Join(repo, "branches", branch), path.Join(repo, "commits", commit), true)
+	if err := fs.Snapshot(path.Join(repo, "branches", branch), path.Join(repo, "commits", commit), true); err != nil {
+		return "", err
+	}
+	if fs.cache != nil {
+		// A snapshot's files can reuse inode numbers from its source
+		// subvolume, so a cache keyed only by inode can't safely carry
+		// entries across a Commit; drop everything rather than risk
+		// serving another subvolume's block for the same inode.
+		fs.cache.invalidateAll()
+	}
+	return commit, nil
 }
 
 func (fs *FS) Branch(repo, commit, branch string) error {
@@ -0,0 +1,280 @@
+package btrfs
+
+import (
+	"io"
+	"os"
+	"sync"
+	"syscall"
+
+	lru "github.com/hashicorp/golang-lru"
+)
+
+const (
+	defaultCacheSize  = 1 << 30 // 1GB total
+	defaultBlockSize  = 1 << 20 // 1MB blocks
+	defaultPerFileCap = 100 << 20
+)
+
+// ReadSeekCloser is what FS.OpenCached returns: a cached file behaves like
+// an *os.File for reading and seeking, without exposing Write.
+type ReadSeekCloser interface {
+	io.Reader
+	io.Seeker
+	io.Closer
+}
+
+// WithCache returns a copy of fs whose OpenCached serves repeated reads of
+// the same blocks from memory instead of the underlying btrfs subvolume --
+// Pachyderm workers otherwise re-read the same input files from disk once
+// per datum in a job. cacheSizeBytes bounds total memory used across all
+// files; blockSize is the granularity reads are cached at. Zero values fall
+// back to 1GB total / 1MB blocks.
+func (fs *FS) WithCache(cacheSizeBytes, blockSize int64) (*FS, error) {
+	if cacheSizeBytes <= 0 {
+		cacheSizeBytes = defaultCacheSize
+	}
+	if blockSize <= 0 {
+		blockSize = defaultBlockSize
+	}
+	cache, err := newBlockCache(cacheSizeBytes, blockSize)
+	if err != nil {
+		return nil, err
+	}
+	return &FS{namespace: fs.namespace, codec: fs.codec, keyProvider: fs.keyProvider, cache: cache}, nil
+}
+
+// OpenCached opens name and returns a ReadSeekCloser whose reads are served
+// out of fs's block cache, falling back to the underlying file on a miss.
+// If fs has no cache (WithCache was never called), it's equivalent to
+// Open.
+func (fs *FS) OpenCached(name string) (ReadSeekCloser, error) {
+	f, err := fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	if fs.cache == nil {
+		return f, nil
+	}
+	inode, err := inodeOf(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &cachedFile{f: f, inode: inode, cache: fs.cache}, nil
+}
+
+func inodeOf(f *os.File) (uint64, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, nil
+	}
+	return stat.Ino, nil
+}
+
+type cachedFile struct {
+	f      *os.File
+	inode  uint64
+	cache  *blockCache
+	offset int64
+}
+
+func (c *cachedFile) Read(p []byte) (int, error) {
+	n, err := c.ReadAt(p, c.offset)
+	c.offset += int64(n)
+	return n, err
+}
+
+func (c *cachedFile) ReadAt(p []byte, off int64) (int, error) {
+	return c.cache.readAt(c.inode, c.f, p, off)
+}
+
+func (c *cachedFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+		c.offset = offset
+	case io.SeekCurrent:
+		c.offset += offset
+	case io.SeekEnd:
+		info, err := c.f.Stat()
+		if err != nil {
+			return 0, err
+		}
+		c.offset = info.Size() + offset
+	}
+	return c.offset, nil
+}
+
+func (c *cachedFile) Close() error {
+	return c.f.Close()
+}
+
+// blockCache holds, per inode, an LRU of recently-read blocks. It's
+// implemented as an LRU of per-file LRUs so that one large, rarely-reused
+// file can't push every other file's blocks out of the cache: at most
+// perFileBlocks blocks (~100MB worth, or the whole cache if that's
+// smaller) of any single inode are kept, and the
+// files LRU bounds how many such per-file caches coexist so total memory
+// stays within cacheSizeBytes.
+type blockCache struct {
+	blockSize     int64
+	perFileBlocks int
+	files         *lru.Cache
+	locksMu       sync.Mutex
+	blockLocks    map[blockLockKey]*refMutex
+}
+
+func newBlockCache(cacheSizeBytes, blockSize int64) (*blockCache, error) {
+	perFileBlocks := int(defaultPerFileCap / blockSize)
+	if maxBlocks := int(cacheSizeBytes / blockSize); perFileBlocks > maxBlocks {
+		perFileBlocks = maxBlocks
+	}
+	if perFileBlocks < 1 {
+		perFileBlocks = 1
+	}
+	maxFiles := int(cacheSizeBytes / (int64(perFileBlocks) * blockSize))
+	if maxFiles < 1 {
+		maxFiles = 1
+	}
+	files, err := lru.New(maxFiles)
+	if err != nil {
+		return nil, err
+	}
+	return &blockCache{
+		blockSize:     blockSize,
+		perFileBlocks: perFileBlocks,
+		files:         files,
+		blockLocks:    make(map[blockLockKey]*refMutex),
+	}, nil
+}
+
+func (bc *blockCache) fileCache(inode uint64) (*lru.Cache, error) {
+	if v, ok := bc.files.Get(inode); ok {
+		return v.(*lru.Cache), nil
+	}
+	blocks, err := lru.New(bc.perFileBlocks)
+	if err != nil {
+		return nil, err
+	}
+	bc.files.Add(inode, blocks)
+	return blocks, nil
+}
+
+type blockLockKey struct {
+	inode uint64
+	block int64
+}
+
+// refMutex is a mutex that knows how many goroutines currently hold a
+// reference to it, so its owning map can tell when it's safe to drop the
+// entry: deleting it while a waiter is still queued on mu would let a later
+// arrival LoadOrStore a fresh mutex and race the one actually doing the
+// read.
+type refMutex struct {
+	mu   sync.Mutex
+	refs int
+}
+
+// acquireBlockLock returns the refMutex for key, creating it if this is the
+// first goroutine to want it, and records that the caller holds a
+// reference. The increment happens under locksMu together with the map
+// lookup so a concurrent releaseBlockLock can never delete the entry out
+// from under a goroutine that's about to wait on it.
+func (bc *blockCache) acquireBlockLock(key blockLockKey) *refMutex {
+	bc.locksMu.Lock()
+	defer bc.locksMu.Unlock()
+	rm, ok := bc.blockLocks[key]
+	if !ok {
+		rm = &refMutex{}
+		bc.blockLocks[key] = rm
+	}
+	rm.refs++
+	return rm
+}
+
+// releaseBlockLock drops the caller's reference to key's refMutex, deleting
+// it from blockLocks once the last reference is gone.
+func (bc *blockCache) releaseBlockLock(key blockLockKey, rm *refMutex) {
+	bc.locksMu.Lock()
+	defer bc.locksMu.Unlock()
+	rm.refs--
+	if rm.refs == 0 {
+		delete(bc.blockLocks, key)
+	}
+}
+
+// loadBlock returns the bytes of the given block of inode, reading it from
+// f and caching the result on a miss. Concurrent misses for the same block
+// coalesce onto a single disk read via a per-(inode,block) refMutex.
+func (bc *blockCache) loadBlock(inode uint64, f *os.File, block int64) ([]byte, error) {
+	blocks, err := bc.fileCache(inode)
+	if err != nil {
+		return nil, err
+	}
+	if data, ok := blocks.Get(block); ok {
+		return data.([]byte), nil
+	}
+
+	key := blockLockKey{inode, block}
+	rm := bc.acquireBlockLock(key)
+	rm.mu.Lock()
+	defer func() {
+		rm.mu.Unlock()
+		bc.releaseBlockLock(key, rm)
+	}()
+
+	if data, ok := blocks.Get(block); ok {
+		return data.([]byte), nil
+	}
+
+	buf := make([]byte, bc.blockSize)
+	n, err := f.ReadAt(buf, block*bc.blockSize)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	buf = buf[:n]
+	blocks.Add(block, buf)
+	return buf, nil
+}
+
+func (bc *blockCache) readAt(inode uint64, f *os.File, p []byte, off int64) (int, error) {
+	total := 0
+	for total < len(p) {
+		block := (off + int64(total)) / bc.blockSize
+		blockOff := (off + int64(total)) % bc.blockSize
+
+		data, err := bc.loadBlock(inode, f, block)
+		if err != nil {
+			return total, err
+		}
+		if blockOff >= int64(len(data)) {
+			if total == 0 {
+				return 0, io.EOF
+			}
+			return total, io.EOF
+		}
+		n := copy(p[total:], data[blockOff:])
+		total += n
+		if int64(len(data)) < bc.blockSize && total < len(p) {
+			return total, io.EOF
+		}
+	}
+	return total, nil
+}
+
+// invalidate drops every cached block belonging to f's inode.
+func (bc *blockCache) invalidate(f *os.File) {
+	inode, err := inodeOf(f)
+	if err != nil {
+		return
+	}
+	bc.files.Remove(inode)
+}
+
+// invalidateAll drops every cached block for every inode.
+func (bc *blockCache) invalidateAll() {
+	bc.files.Purge()
+}
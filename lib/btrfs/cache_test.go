@@ -0,0 +1,104 @@
+package btrfs
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func writeTempFile(t *testing.T, data []byte) *os.File {
+	t.Helper()
+	f, err := ioutil.TempFile("", "btrfs-cache-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		f.Close()
+		os.Remove(f.Name())
+	})
+	if _, err := f.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestBlockCacheReadAtRoundTrip(t *testing.T) {
+	data := bytes.Repeat([]byte("abcdefgh"), 1000) // 8000 bytes
+	f := writeTempFile(t, data)
+
+	bc, err := newBlockCache(1<<20, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inode, err := inodeOf(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := make([]byte, len(data))
+	n, err := bc.readAt(inode, f, got, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(data) || !bytes.Equal(got, data) {
+		t.Fatalf("round trip mismatch: got %d bytes", n)
+	}
+
+	// A second read of the same range should be served from cache and
+	// still match.
+	got2 := make([]byte, len(data))
+	if _, err := bc.readAt(inode, f, got2, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got2, data) {
+		t.Fatal("cached read mismatch")
+	}
+}
+
+func TestLoadBlockCoalescesConcurrentMisses(t *testing.T) {
+	data := bytes.Repeat([]byte("z"), 4096)
+	f := writeTempFile(t, data)
+
+	bc, err := newBlockCache(1<<20, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inode, err := inodeOf(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const n = 100
+	var wg sync.WaitGroup
+	var reads int64
+	wg.Add(n)
+	start := make(chan struct{})
+	for i := 0; i < n; i++ {
+		go func() {
+			defer wg.Done()
+			<-start
+			if _, err := bc.loadBlock(inode, f, 0); err != nil {
+				t.Error(err)
+			}
+			atomic.AddInt64(&reads, 1)
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	if reads != n {
+		t.Fatalf("expected all %d goroutines to complete, got %d", n, reads)
+	}
+	// blockLocks must be empty again now that every waiter has returned --
+	// a leaked entry here is the signature of the delete-before-last-waiter
+	// race this test guards against.
+	bc.locksMu.Lock()
+	leaked := len(bc.blockLocks)
+	bc.locksMu.Unlock()
+	if leaked != 0 {
+		t.Fatalf("expected blockLocks to be empty, found %d entries", leaked)
+	}
+}
@@ -0,0 +1,624 @@
+package btrfs
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+const (
+	objectsDir = "objects"
+
+	minChunkSize = 512 * 1024
+	maxChunkSize = 4 * 1024 * 1024
+	chunkMask    = (1 << 20) - 1
+
+	rabinWindow = 64
+	rabinPrime  = 153191
+)
+
+// ChunkRef is one content-addressed chunk within a file's Manifest.
+type ChunkRef struct {
+	Hash   string `json:"hash"`
+	Offset int64  `json:"offset"`
+	Len    int64  `json:"len"`
+}
+
+// Manifest records the ordered chunks that make up a logical file so that
+// its content can be reassembled from the object store.
+type Manifest struct {
+	Chunks    []ChunkRef `json:"chunks"`
+	TotalSize int64      `json:"total_size"`
+}
+
+// rabinChunker splits a byte stream into variable-size chunks using a
+// sliding-window rolling hash over the last rabinWindow bytes, emitting a
+// chunk boundary whenever the low bits of the fingerprint match chunkMask
+// (targeting ~1MB chunks) or maxChunkSize is reached.
+type rabinChunker struct {
+	br     *bufio.Reader
+	window [rabinWindow]byte
+	pos    int
+	fp     uint64
+	pow    uint64 // rabinPrime^(rabinWindow-1), used to subtract the outgoing byte
+}
+
+func newRabinChunker(r io.Reader) *rabinChunker {
+	pow := uint64(1)
+	for i := 0; i < rabinWindow-1; i++ {
+		pow *= rabinPrime
+	}
+	return &rabinChunker{br: bufio.NewReaderSize(r, maxChunkSize), pow: pow}
+}
+
+// next returns the bytes of the next chunk, or io.EOF once the underlying
+// reader is exhausted.
+func (c *rabinChunker) next() ([]byte, error) {
+	buf := make([]byte, 0, minChunkSize)
+	for {
+		b, err := c.br.ReadByte()
+		if err != nil {
+			if err == io.EOF && len(buf) > 0 {
+				return buf, nil
+			}
+			return nil, err
+		}
+		buf = append(buf, b)
+
+		out := c.window[c.pos]
+		c.window[c.pos] = b
+		c.pos = (c.pos + 1) % rabinWindow
+		c.fp = c.fp*rabinPrime + uint64(b) - uint64(out)*c.pow*rabinPrime
+
+		if len(buf) >= minChunkSize && (len(buf) >= maxChunkSize || c.fp&chunkMask == chunkMask) {
+			return buf, nil
+		}
+	}
+}
+
+// plainTag is the object-store tag used for chunks written with no Codec.
+const plainTag = "plain"
+
+// objectPath locates a chunk under objects/, namespaced by the identity of
+// the Codec that produced the bytes on disk (tag), not just its content
+// hash. Two chunks with identical plaintext but different Codecs (or no
+// Codec at all) must never share a path: the same hash written once
+// through storeChunk with no codec and again with, say, AES-GCM would
+// otherwise "dedup" to a single file whose on-disk bytes match only one of
+// the two Codecs, and OpenChunked would decode the other with the wrong
+// Codec. See codecTagOf/resolveCodecTag.
+func objectPath(tag, hash string) string {
+	return path.Join(objectsDir, tag, hash[:2], hash)
+}
+
+// codecTagOf returns the object-store tag for codec: plainTag if codec is
+// nil, otherwise codec.Name().
+func codecTagOf(codec Codec) string {
+	if codec == nil {
+		return plainTag
+	}
+	return codec.Name()
+}
+
+// resolveCodecTag returns the object-store tag that name's chunks were
+// written under: whatever its codec sidecar recorded, or plainTag if it has
+// none (the file was written with fs.codec == nil).
+func (fs *FS) resolveCodecTag(name string) (string, error) {
+	codecName, err := fs.readCodecMeta(name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return plainTag, nil
+		}
+		return "", err
+	}
+	if codecName == "" {
+		return plainTag, nil
+	}
+	return codecName, nil
+}
+
+func manifestPath(name string) string {
+	return name + ".manifest"
+}
+
+// createObject atomically creates rel by invoking write against a fresh
+// tmp file and renaming it into place, cleaning up the tmp file on any
+// failure.
+func (fs *FS) createObject(rel string, write func(io.Writer) error) error {
+	if err := fs.MkdirAll(path.Dir(rel)); err != nil {
+		return err
+	}
+	tmpRel := rel + ".tmp-" + RandSeq(8)
+	f, err := fs.Create(tmpRel)
+	if err != nil {
+		return err
+	}
+	if err := write(f); err != nil {
+		f.Close()
+		fs.Remove(tmpRel)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		fs.Remove(tmpRel)
+		return err
+	}
+	if err := os.Rename(fs.FilePath(tmpRel), fs.FilePath(rel)); err != nil {
+		fs.Remove(tmpRel)
+		return err
+	}
+	return nil
+}
+
+// writeChunk stores data verbatim under the content-addressed object
+// store, tagged with tag, deduplicating against any chunk already present
+// under that same tag, and returns its hash, taken over data itself. Used
+// where data is already in its final at-rest form: storeChunk calls it for
+// chunks written with no Codec, whose plaintext is what goes on disk. For
+// data that still needs to go through a Codec, use storeChunk instead.
+func (fs *FS) writeChunk(tag string, data []byte) (string, error) {
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+	return hash, fs.writeChunkAt(tag, hash, data)
+}
+
+// writeChunkAt stores data verbatim under the object-store path for
+// (tag, hash), deduplicating if it's already present. Unlike writeChunk,
+// the caller supplies hash rather than having it derived from data: used
+// by RecvDedup, where hash is the manifest's plaintext chunk hash but data
+// is whatever bytes the sender's Codec (if any) actually produced for it,
+// so re-hashing data itself would neither match the manifest nor dedup
+// against anything written by storeChunk on the sending side.
+func (fs *FS) writeChunkAt(tag, hash string, data []byte) error {
+	rel := objectPath(tag, hash)
+
+	exists, err := fs.FileExists(rel)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+	return fs.createObject(rel, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+// storeChunk hashes plain -- the chunk's plaintext content, before any
+// Codec runs -- so that identical data dedups the same way regardless of a
+// non-deterministic Codec like AES-GCM (whose random nonce would otherwise
+// make every encoded copy of the same bytes hash differently). It then
+// writes plain to the object store through codec, if any, tagged with
+// codec's own identity (codecTagOf) so a chunk written with one Codec (or
+// none) never collides with the same content written through another.
+// codec is resolved once per file by the caller (see chunkAndStore), since
+// a per-file key from fs.keyProvider must stay the same across every chunk
+// of that file.
+func (fs *FS) storeChunk(codec Codec, plain []byte) (string, error) {
+	if codec == nil {
+		return fs.writeChunk(plainTag, plain)
+	}
+
+	sum := sha256.Sum256(plain)
+	hash := hex.EncodeToString(sum[:])
+	rel := objectPath(codecTagOf(codec), hash)
+
+	exists, err := fs.FileExists(rel)
+	if err != nil {
+		return "", err
+	}
+	if exists {
+		return hash, nil
+	}
+	if err := fs.createObject(rel, func(w io.Writer) error {
+		enc := codec.Encode(w)
+		if _, err := enc.Write(plain); err != nil {
+			enc.Close()
+			return err
+		}
+		return enc.Close()
+	}); err != nil {
+		return "", err
+	}
+	return hash, nil
+}
+
+func (fs *FS) readChunk(tag, hash string) ([]byte, error) {
+	f, err := fs.Open(objectPath(tag, hash))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
+
+// chunkAndStore splits r into content-addressed chunks and returns the
+// resulting Manifest. r is always the plaintext: chunking happens before
+// codec runs (see storeChunk), so chunk boundaries and dedup depend only on
+// content, never on a Codec's own framing or nonces. Chunks already present
+// in the object store are not written again.
+func (fs *FS) chunkAndStore(codec Codec, r io.Reader) (*Manifest, error) {
+	if err := fs.MkdirAll(objectsDir); err != nil {
+		return nil, err
+	}
+	manifest := &Manifest{}
+	chunker := newRabinChunker(r)
+	for {
+		data, err := chunker.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		hash, err := fs.storeChunk(codec, data)
+		if err != nil {
+			return nil, err
+		}
+		manifest.Chunks = append(manifest.Chunks, ChunkRef{
+			Hash:   hash,
+			Offset: manifest.TotalSize,
+			Len:    int64(len(data)),
+		})
+		manifest.TotalSize += int64(len(data))
+	}
+	return manifest, nil
+}
+
+// writeManifest persists manifest for name atomically via rename.
+func (fs *FS) writeManifest(name string, manifest *Manifest) error {
+	rel := manifestPath(name)
+	tmpRel := rel + ".tmp-" + RandSeq(8)
+	f, err := fs.Create(tmpRel)
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(f).Encode(manifest); err != nil {
+		f.Close()
+		fs.Remove(tmpRel)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		fs.Remove(tmpRel)
+		return err
+	}
+	return os.Rename(fs.FilePath(tmpRel), fs.FilePath(rel))
+}
+
+func (fs *FS) readManifest(name string) (*Manifest, error) {
+	f, err := fs.Open(manifestPath(name))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	manifest := &Manifest{}
+	if err := json.NewDecoder(f).Decode(manifest); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// CreateFromReader reads r, splits it into content-addressed chunks that
+// are deduplicated against the object store (running each chunk through
+// the Codec resolved for name, if any, as it's written -- see
+// fs.writeCodec/storeChunk), and records a Manifest for name.
+func (fs *FS) CreateFromReader(name string, r io.Reader) (int64, error) {
+	codec, err := fs.writeCodec(name)
+	if err != nil {
+		return 0, err
+	}
+	manifest, err := fs.chunkAndStore(codec, r)
+	if err != nil {
+		return 0, err
+	}
+	if err := fs.writeManifest(name, manifest); err != nil {
+		return 0, err
+	}
+	if codec != nil {
+		if err := fs.writeCodecMeta(name, codec.Name()); err != nil {
+			return 0, err
+		}
+	}
+	return manifest.TotalSize, nil
+}
+
+// WriteFile is the update counterpart of CreateFromReader: it reads r,
+// deduplicates its chunks against the object store, and replaces name's
+// Manifest.
+func (fs *FS) WriteFile(name string, r io.Reader) (int64, error) {
+	return fs.CreateFromReader(name, r)
+}
+
+// OpenChunked returns a ReadCloser that reassembles name's content on the
+// fly from the chunks referenced by its Manifest. Each chunk was encoded
+// independently by storeChunk, so each is decoded independently here
+// (auto-selecting the Codec via the file's codec sidecar, resolving a
+// per-file key through fs.keyProvider if the sidecar calls for one, and
+// falling back to fs's own Codec) rather than decoding the concatenated
+// stream as one message.
+func (fs *FS) OpenChunked(name string) (io.ReadCloser, error) {
+	manifest, err := fs.readManifest(name)
+	if err != nil {
+		return nil, err
+	}
+	tag, err := fs.resolveCodecTag(name)
+	if err != nil {
+		return nil, err
+	}
+	codec, err := fs.resolveCodec(name)
+	if err != nil {
+		return nil, err
+	}
+	readers := make([]io.Reader, len(manifest.Chunks))
+	files := make([]*os.File, len(manifest.Chunks))
+	var decoders []io.Closer
+	for i, chunk := range manifest.Chunks {
+		f, err := fs.Open(objectPath(tag, chunk.Hash))
+		if err != nil {
+			return nil, err
+		}
+		files[i] = f
+		if codec == nil {
+			readers[i] = f
+			continue
+		}
+		dec := codec.Decode(f)
+		readers[i] = dec
+		decoders = append(decoders, dec)
+	}
+	return &chunkedReader{Reader: io.MultiReader(readers...), files: files, decoders: decoders}, nil
+}
+
+type chunkedReader struct {
+	io.Reader
+	files    []*os.File
+	decoders []io.Closer
+}
+
+func (c *chunkedReader) Close() error {
+	var err error
+	for _, dec := range c.decoders {
+		if cerr := dec.Close(); cerr != nil {
+			err = cerr
+		}
+	}
+	for _, f := range c.files {
+		if cerr := f.Close(); cerr != nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// missingChunks returns the hashes from manifest that this FS's object
+// store does not already have under tag (the codec identity the caller
+// will store them as -- see SendDedup/RecvDedup).
+func (fs *FS) missingChunks(tag string, manifest *Manifest) ([]string, error) {
+	var missing []string
+	seen := make(map[string]bool)
+	for _, chunk := range manifest.Chunks {
+		if seen[chunk.Hash] {
+			continue
+		}
+		seen[chunk.Hash] = true
+		exists, err := fs.FileExists(objectPath(tag, chunk.Hash))
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			missing = append(missing, chunk.Hash)
+		}
+	}
+	return missing, nil
+}
+
+// dedupEnvelope is what SendDedup writes ahead of the chunk bodies
+// themselves: the Manifest plus the object-store tag its chunks were
+// written under (see objectPath), since the receiver must store the
+// verbatim bytes it gets back under that same tag -- it can't infer the
+// sender's Codec from its own.
+type dedupEnvelope struct {
+	Manifest *Manifest `json:"manifest"`
+	CodecTag string    `json:"codec_tag"`
+}
+
+// SendDedup ships name to a peer by first writing its Manifest (and the
+// object-store tag its chunks are stored under) to w and reading back, as
+// JSON, the subset of hashes the peer is missing; only those chunk bodies
+// (each framed with an 8-byte big-endian length prefix) are then written
+// to w. The transport backing w/r is up to the caller.
+//
+// This is deliberately separate from FS.Send/FS.Recv (btrfs.go), which
+// replicate a whole subvolume by moving the `btrfs send` stream itself:
+// that stream has no notion of the chunk store, so there's no missing-chunk
+// negotiation to do at that level, and this one only applies to individual
+// content-addressed files, not a subvolume's full btrfs metadata.
+func (fs *FS) SendDedup(name string, w io.Writer, r io.Reader) error {
+	manifest, err := fs.readManifest(name)
+	if err != nil {
+		return err
+	}
+	tag, err := fs.resolveCodecTag(name)
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(w).Encode(&dedupEnvelope{Manifest: manifest, CodecTag: tag}); err != nil {
+		return err
+	}
+	var missing []string
+	if err := json.NewDecoder(r).Decode(&missing); err != nil {
+		return err
+	}
+	for _, hash := range missing {
+		data, err := fs.readChunk(tag, hash)
+		if err != nil {
+			return err
+		}
+		if err := binary.Write(w, binary.BigEndian, int64(len(data))); err != nil {
+			return err
+		}
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RecvDedup is the receive side of SendDedup: it reads the sender's
+// Manifest and codec tag from r, replies on w with the hashes this FS
+// lacks, reads back just those chunk bodies, stores them verbatim under
+// the sender's tag (they're already in that Codec's at-rest form -- this
+// FS's own fs.codec, if any, is irrelevant to bytes it didn't encode), and
+// writes the Manifest for name once every chunk is present locally.
+func (fs *FS) RecvDedup(name string, r io.Reader, w io.Writer) error {
+	envelope := &dedupEnvelope{Manifest: &Manifest{}}
+	if err := json.NewDecoder(r).Decode(envelope); err != nil {
+		return err
+	}
+	manifest, tag := envelope.Manifest, envelope.CodecTag
+	if tag == "" {
+		tag = plainTag
+	}
+	missing, err := fs.missingChunks(tag, manifest)
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(w).Encode(missing); err != nil {
+		return err
+	}
+	if err := fs.MkdirAll(objectsDir); err != nil {
+		return err
+	}
+	for _, hash := range missing {
+		var n int64
+		if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+			return err
+		}
+		data := make([]byte, n)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return err
+		}
+		if err := fs.writeChunkAt(tag, hash, data); err != nil {
+			return err
+		}
+	}
+	if tag != plainTag {
+		if err := fs.writeCodecMeta(name, tag); err != nil {
+			return err
+		}
+	}
+	return fs.writeManifest(name, manifest)
+}
+
+// FSCK walks every Manifest reachable from branches/ and commits/ of every
+// repo in fs's namespace and removes any object under objects/ that isn't
+// referenced, returning the number of chunks it pruned. objects/ is shared
+// by the whole namespace (Init can be called once per repo but they all
+// land under the same FS), so pruning against a single repo's live set
+// would delete chunks still referenced by every other repo sharing it --
+// FSCK therefore always computes the live set across the whole namespace,
+// never just one repo.
+func (fs *FS) FSCK() (int, error) {
+	live := make(map[string]bool)
+	infos, err := fs.ReadDir("")
+	if err != nil {
+		return 0, err
+	}
+	for _, info := range infos {
+		if !info.IsDir() || info.Name() == objectsDir {
+			continue
+		}
+		repo := info.Name()
+		for _, dir := range []string{"branches", "commits"} {
+			if err := fs.walkManifests(path.Join(repo, dir), live); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return fs.pruneUnreferenced(live)
+}
+
+func (fs *FS) walkManifests(dir string, live map[string]bool) error {
+	infos, err := fs.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, info := range infos {
+		name := path.Join(dir, info.Name())
+		if info.IsDir() {
+			if err := fs.walkManifests(name, live); err != nil {
+				return err
+			}
+			continue
+		}
+		if path.Ext(name) != ".manifest" {
+			continue
+		}
+		fileName := strings.TrimSuffix(name, ".manifest")
+		manifest, err := fs.readManifest(fileName)
+		if err != nil {
+			continue
+		}
+		tag, err := fs.resolveCodecTag(fileName)
+		if err != nil {
+			continue
+		}
+		for _, chunk := range manifest.Chunks {
+			live[path.Join(tag, chunk.Hash)] = true
+		}
+	}
+	return nil
+}
+
+// pruneUnreferenced removes every object under objects/<tag>/<prefix>/<hash>
+// whose "<tag>/<hash>" key isn't in live, returning the number it removed.
+func (fs *FS) pruneUnreferenced(live map[string]bool) (int, error) {
+	pruned := 0
+	tags, err := fs.ReadDir(objectsDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	for _, tagInfo := range tags {
+		if !tagInfo.IsDir() {
+			continue
+		}
+		tagDir := path.Join(objectsDir, tagInfo.Name())
+		prefixes, err := fs.ReadDir(tagDir)
+		if err != nil {
+			return pruned, err
+		}
+		for _, prefix := range prefixes {
+			if !prefix.IsDir() {
+				continue
+			}
+			prefixDir := path.Join(tagDir, prefix.Name())
+			objs, err := fs.ReadDir(prefixDir)
+			if err != nil {
+				return pruned, err
+			}
+			for _, obj := range objs {
+				if live[path.Join(tagInfo.Name(), obj.Name())] {
+					continue
+				}
+				if err := fs.Remove(path.Join(prefixDir, obj.Name())); err != nil {
+					return pruned, err
+				}
+				pruned++
+			}
+		}
+	}
+	return pruned, nil
+}
@@ -0,0 +1,225 @@
+package btrfs
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// TestRabinChunkerRespectsSizeBounds checks the chunker's three invariants
+// directly: no chunk (other than the final, end-of-stream one) is smaller
+// than minChunkSize, none exceeds maxChunkSize, and every byte of the
+// input is accounted for across the chunks it produces.
+func TestRabinChunkerRespectsSizeBounds(t *testing.T) {
+	src := rand.New(rand.NewSource(1))
+	data := make([]byte, 5*maxChunkSize)
+	src.Read(data)
+
+	chunker := newRabinChunker(bytes.NewReader(data))
+	var chunks [][]byte
+	for {
+		chunk, err := chunker.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		chunks = append(chunks, chunk)
+	}
+	if len(chunks) < 2 {
+		t.Fatalf("expected multiple chunks from %d bytes of random data, got %d", len(data), len(chunks))
+	}
+
+	var total int
+	for i, chunk := range chunks {
+		if len(chunk) > maxChunkSize {
+			t.Fatalf("chunk %d exceeds maxChunkSize: %d bytes", i, len(chunk))
+		}
+		if i < len(chunks)-1 && len(chunk) < minChunkSize {
+			t.Fatalf("non-final chunk %d is below minChunkSize: %d bytes", i, len(chunk))
+		}
+		total += len(chunk)
+	}
+	if total != len(data) {
+		t.Fatalf("chunker dropped bytes: reassembled %d, want %d", total, len(data))
+	}
+}
+
+// TestCreateFromReaderDedupsAcrossFiles checks dedup at the level
+// CreateFromReader actually exercises it: two different files whose
+// content shares a chunk must produce Manifests referencing the identical
+// hash, backed by a single object on disk.
+func TestCreateFromReaderDedupsAcrossFiles(t *testing.T) {
+	withTestVolume(t)
+	fs := NewFS("ns")
+	if err := fs.MkdirAll(""); err != nil {
+		t.Fatal(err)
+	}
+
+	shared := bytes.Repeat([]byte("shared"), minChunkSize)
+	if _, err := fs.CreateFromReader("f1", bytes.NewReader(shared)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.CreateFromReader("f2", bytes.NewReader(shared)); err != nil {
+		t.Fatal(err)
+	}
+
+	m1, err := fs.readManifest("f1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m2, err := fs.readManifest("f2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m1.Chunks) == 0 || len(m1.Chunks) != len(m2.Chunks) {
+		t.Fatalf("expected identical chunking for identical content: %d vs %d chunks", len(m1.Chunks), len(m2.Chunks))
+	}
+	for i := range m1.Chunks {
+		if m1.Chunks[i].Hash != m2.Chunks[i].Hash {
+			t.Fatalf("chunk %d hash differs between files with identical content", i)
+		}
+	}
+
+	objs, err := fs.ReadDir(filepath.Join(objectsDir, plainTag, m1.Chunks[0].Hash[:2]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objs) != len(m1.Chunks) {
+		t.Fatalf("expected one object per unique chunk (%d), found %d", len(m1.Chunks), len(objs))
+	}
+}
+
+// TestSendDedupRecvDedupRoundTrip drives SendDedup/RecvDedup between two
+// independent FS namespaces over a pair of pipes, the way two replication
+// peers would be connected, and checks that the destination ends up with
+// byte-identical content from only the manifest plus the chunks it
+// actually lacked.
+func TestSendDedupRecvDedupRoundTrip(t *testing.T) {
+	withTestVolume(t)
+	src := NewFS("src")
+	if err := src.MkdirAll(""); err != nil {
+		t.Fatal(err)
+	}
+	dst := NewFS("dst")
+	if err := dst.MkdirAll(""); err != nil {
+		t.Fatal(err)
+	}
+
+	data := bytes.Repeat([]byte("replicate-me-"), 100000) // 1.3MB, well above minChunkSize
+	if _, err := src.CreateFromReader("f", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	dstReadsSrc, srcToDst := io.Pipe()
+	srcReadsDst, dstToSrc := io.Pipe()
+
+	var wg sync.WaitGroup
+	var sendErr, recvErr error
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		defer srcToDst.Close()
+		sendErr = src.SendDedup("f", srcToDst, srcReadsDst)
+	}()
+	go func() {
+		defer wg.Done()
+		defer dstToSrc.Close()
+		recvErr = dst.RecvDedup("f", dstReadsSrc, dstToSrc)
+	}()
+	wg.Wait()
+	if sendErr != nil {
+		t.Fatalf("SendDedup: %v", sendErr)
+	}
+	if recvErr != nil {
+		t.Fatalf("RecvDedup: %v", recvErr)
+	}
+
+	r, err := dst.OpenChunked("f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("round trip mismatch: got %d bytes, want %d", len(got), len(data))
+	}
+}
+
+// TestFSCKPrunesAcrossWholeNamespaceNotJustOneRepo is the regression test
+// for the GC data-loss bug: objects/ lives at the namespace root and is
+// shared by every repo, so FSCK must compute its live set from every repo
+// under the namespace, not just the one a caller happens to be thinking
+// about -- otherwise running it while onboarding or GC'ing one repo would
+// delete chunks still referenced by every other repo sharing the FS.
+func TestFSCKPrunesAcrossWholeNamespaceNotJustOneRepo(t *testing.T) {
+	withTestVolume(t)
+	fs := NewFS("ns")
+	if err := fs.MkdirAll(""); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, repo := range []string{"repoA", "repoB"} {
+		if err := fs.MkdirAll(repo + "/branches/master"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dataA := bytes.Repeat([]byte("a"), minChunkSize)
+	if _, err := fs.CreateFromReader("repoA/branches/master/f", bytes.NewReader(dataA)); err != nil {
+		t.Fatal(err)
+	}
+	dataB := bytes.Repeat([]byte("b"), minChunkSize)
+	if _, err := fs.CreateFromReader("repoB/branches/master/g", bytes.NewReader(dataB)); err != nil {
+		t.Fatal(err)
+	}
+
+	pruned, err := fs.FSCK()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pruned != 0 {
+		t.Fatalf("FSCK pruned %d objects still referenced by repoA or repoB", pruned)
+	}
+
+	// Both files must still be readable: a repo-scoped FSCK would have
+	// pruned whichever repo it wasn't told about.
+	for name, want := range map[string][]byte{
+		"repoA/branches/master/f": dataA,
+		"repoB/branches/master/g": dataB,
+	} {
+		r, err := fs.OpenChunked(name)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		got := make([]byte, len(want))
+		if _, err := io.ReadFull(r, got); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		r.Close()
+		if !bytes.Equal(got, want) {
+			t.Fatalf("%s: content mismatch after FSCK", name)
+		}
+	}
+
+	// Now drop repoB's only file and confirm its now-unreferenced chunk
+	// does get pruned, to make sure FSCK isn't just a no-op.
+	if err := fs.Remove("repoB/branches/master/g.manifest"); err != nil {
+		t.Fatal(err)
+	}
+	pruned, err = fs.FSCK()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pruned == 0 {
+		t.Fatal("expected FSCK to prune repoB's now-unreferenced chunk")
+	}
+}
@@ -0,0 +1,268 @@
+package btrfs
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Codec is a reversible transform (compression, encryption, ...) that FS can
+// apply to data on its way to and from disk.
+type Codec interface {
+	// Name identifies the codec so it can be recorded in a file's codec
+	// sidecar and looked back up on read.
+	Name() string
+	Encode(w io.Writer) io.WriteCloser
+	Decode(r io.Reader) io.ReadCloser
+}
+
+// KeyProvider supplies the encryption key for a given file, so that FS and
+// its Codecs don't need to know how keys are minted or stored (KMS, local
+// keyring, etc).
+type KeyProvider interface {
+	Key(name string) ([]byte, error)
+}
+
+// codecRegistry holds the stateless Codecs (no key material) that a codec
+// sidecar can name directly, letting reads auto-select the inverse
+// transform without the caller re-specifying it via WithCodec.
+var codecRegistry = map[string]func() Codec{
+	"gzip":   func() Codec { return NewGzipCodec() },
+	"zstd":   func() Codec { return NewZstdCodec() },
+	"snappy": func() Codec { return NewSnappyCodec() },
+}
+
+// WithCodec returns a copy of fs that runs each chunk storeChunk writes
+// through codec.Encode on the way in, and each chunk OpenChunked reads back
+// through codec.Decode on the way out. It carries fs's other settings (e.g.
+// a cache from WithCache, or a keyProvider from WithKeyProvider) forward
+// unchanged, overriding only the Codec, so the withers can be chained in
+// either order without one silently undoing another.
+func (fs *FS) WithCodec(codec Codec) *FS {
+	return &FS{namespace: fs.namespace, codec: codec, keyProvider: fs.keyProvider, cache: fs.cache}
+}
+
+// WithKeyProvider returns a copy of fs that seals each file's chunks with
+// AES-256-GCM under a key resolved per file through kp, instead of the one
+// fixed Codec (and therefore one fixed key) every file shares under
+// WithCodec. Codec.Encode/Decode don't take a file name, so per-file keying
+// can't be expressed as a Codec at all -- it's threaded through writeCodec/
+// resolveCodec instead, keyed by name directly. Like WithCodec, it carries
+// fs's other settings forward unchanged, overriding only keyProvider.
+func (fs *FS) WithKeyProvider(kp KeyProvider) *FS {
+	return &FS{namespace: fs.namespace, codec: fs.codec, keyProvider: kp, cache: fs.cache}
+}
+
+// writeCodec resolves the Codec to encode name's chunks with as they're
+// written: a fresh AES-256-GCM codec keyed through fs.keyProvider if one is
+// set, otherwise fs's own Codec (set via WithCodec), or nil for no codec at
+// all.
+func (fs *FS) writeCodec(name string) (Codec, error) {
+	if fs.keyProvider != nil {
+		key, err := fs.keyProvider.Key(name)
+		if err != nil {
+			return nil, err
+		}
+		return NewAESGCMCodec(key)
+	}
+	return fs.codec, nil
+}
+
+// resolveCodec picks the Codec to decode name with: the one named in its
+// codec sidecar if it's a registered stateless codec; if the sidecar names
+// aesCodecName, a fresh AES-256-GCM codec keyed through fs.keyProvider if
+// one is set; otherwise fs's own Codec (set via WithCodec), which is
+// required for a key-bearing codec the registry can't construct on its own.
+func (fs *FS) resolveCodec(name string) (Codec, error) {
+	if codecName, err := fs.readCodecMeta(name); err == nil && codecName != "" {
+		if factory, ok := codecRegistry[codecName]; ok {
+			return factory(), nil
+		}
+		if codecName == aesCodecName && fs.keyProvider != nil {
+			key, err := fs.keyProvider.Key(name)
+			if err != nil {
+				return nil, err
+			}
+			return NewAESGCMCodec(key)
+		}
+	}
+	return fs.codec, nil
+}
+
+func codecMetaPath(name string) string {
+	return name + ".codec"
+}
+
+func (fs *FS) writeCodecMeta(name, codecName string) error {
+	_, err := fs.CreateFromReaderRaw(codecMetaPath(name), bytes.NewReader([]byte(codecName)))
+	return err
+}
+
+func (fs *FS) readCodecMeta(name string) (string, error) {
+	f, err := fs.Open(codecMetaPath(name))
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// CreateFromReaderRaw writes r to name directly, bypassing chunking and any
+// Codec; it's used for small bookkeeping sidecars (codec names) that don't
+// benefit from either. Manifests are written by writeManifest instead.
+func (fs *FS) CreateFromReaderRaw(name string, r io.Reader) (int64, error) {
+	f, err := fs.Create(name)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return io.Copy(f, r)
+}
+
+// errReadCloser is a no-op ReadCloser that always returns err, used when a
+// Codec's Decode fails to even construct its underlying reader.
+type errReadCloser struct{ err error }
+
+func (e errReadCloser) Read([]byte) (int, error) { return 0, e.err }
+func (e errReadCloser) Close() error             { return nil }
+
+// NewGzipCodec returns a Codec that gzip-compresses chunk data.
+func NewGzipCodec() Codec { return gzipCodec{} }
+
+type gzipCodec struct{}
+
+func (gzipCodec) Name() string { return "gzip" }
+
+func (gzipCodec) Encode(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) }
+
+func (gzipCodec) Decode(r io.Reader) io.ReadCloser {
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		return errReadCloser{err}
+	}
+	return gr
+}
+
+// NewZstdCodec returns a Codec that compresses chunk data with zstd.
+func NewZstdCodec() Codec { return zstdCodec{} }
+
+type zstdCodec struct{}
+
+func (zstdCodec) Name() string { return "zstd" }
+
+func (zstdCodec) Encode(w io.Writer) io.WriteCloser {
+	enc, err := zstd.NewWriter(w)
+	if err != nil {
+		return errWriteCloser{err}
+	}
+	return enc
+}
+
+func (zstdCodec) Decode(r io.Reader) io.ReadCloser {
+	dec, err := zstd.NewReader(r)
+	if err != nil {
+		return errReadCloser{err}
+	}
+	return dec.IOReadCloser()
+}
+
+// NewSnappyCodec returns a Codec that compresses chunk data with snappy.
+func NewSnappyCodec() Codec { return snappyCodec{} }
+
+type snappyCodec struct{}
+
+func (snappyCodec) Name() string { return "snappy" }
+
+func (snappyCodec) Encode(w io.Writer) io.WriteCloser { return snappy.NewBufferedWriter(w) }
+
+func (snappyCodec) Decode(r io.Reader) io.ReadCloser { return ioutil.NopCloser(snappy.NewReader(r)) }
+
+// errWriteCloser is a no-op WriteCloser that always returns err, used when a
+// Codec's Encode fails to even construct its underlying writer.
+type errWriteCloser struct{ err error }
+
+func (e errWriteCloser) Write([]byte) (int, error) { return 0, e.err }
+func (e errWriteCloser) Close() error              { return e.err }
+
+// NewAESGCMCodec returns a Codec that seals data with AES-256-GCM using key
+// (as produced by a KeyProvider). Unlike the compression codecs it is not
+// in codecRegistry, since the key has to come from the caller: a reader
+// either passes an equivalent codec to WithCodec, or, on an FS set up with
+// WithKeyProvider, resolveCodec rebuilds it from an aesCodecName sidecar
+// with the key fs.keyProvider returns for the file.
+func NewAESGCMCodec(key []byte) (Codec, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &aesGCMCodec{gcm: gcm}, nil
+}
+
+// aesCodecName is aesGCMCodec's Name(), broken out as a const so
+// resolveCodec can recognize an AES-GCM sidecar and resolve a per-file key
+// for it through fs.keyProvider.
+const aesCodecName = "aes-256-gcm"
+
+type aesGCMCodec struct {
+	gcm cipher.AEAD
+}
+
+func (c *aesGCMCodec) Name() string { return aesCodecName }
+
+// Encode buffers the plaintext and seals it as a single GCM message on
+// Close, since GCM authenticates a whole message rather than a byte
+// stream. storeChunk calls Encode once per already-chunked piece of data
+// (never once over a whole logical file), so the buffer is capped at
+// maxChunkSize.
+func (c *aesGCMCodec) Encode(w io.Writer) io.WriteCloser {
+	return &aesGCMWriter{gcm: c.gcm, w: w}
+}
+
+func (c *aesGCMCodec) Decode(r io.Reader) io.ReadCloser {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return errReadCloser{err}
+	}
+	if len(data) < c.gcm.NonceSize() {
+		return errReadCloser{io.ErrUnexpectedEOF}
+	}
+	nonce, ciphertext := data[:c.gcm.NonceSize()], data[c.gcm.NonceSize():]
+	plain, err := c.gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return errReadCloser{err}
+	}
+	return ioutil.NopCloser(bytes.NewReader(plain))
+}
+
+type aesGCMWriter struct {
+	gcm cipher.AEAD
+	w   io.Writer
+	buf bytes.Buffer
+}
+
+func (a *aesGCMWriter) Write(p []byte) (int, error) { return a.buf.Write(p) }
+
+func (a *aesGCMWriter) Close() error {
+	nonce := make([]byte, a.gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	sealed := a.gcm.Seal(nonce, nonce, a.buf.Bytes(), nil)
+	_, err := a.w.Write(sealed)
+	return err
+}
@@ -0,0 +1,293 @@
+package btrfs
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// withTestVolume points the package-level volume at a fresh temp dir for
+// the duration of the test, so FS.Create/Open et al. hit a scratch
+// directory instead of the real /var/lib/pfs/vol.
+func withTestVolume(t *testing.T) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "btrfs-codec-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := volume
+	volume = dir
+	t.Cleanup(func() {
+		volume = old
+		os.RemoveAll(dir)
+	})
+}
+
+func TestCreateFromReaderRoundTrip(t *testing.T) {
+	withTestVolume(t)
+	fs := NewFS("ns")
+	if err := fs.MkdirAll(""); err != nil {
+		t.Fatal(err)
+	}
+
+	data := bytes.Repeat([]byte("hello world, "), 100000) // 1.3MB, well above minChunkSize
+	if _, err := fs.CreateFromReader("f", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := fs.OpenChunked("f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("round trip mismatch: got %d bytes, want %d", len(got), len(data))
+	}
+}
+
+func TestCreateFromReaderRoundTripWithCodec(t *testing.T) {
+	withTestVolume(t)
+	key := bytes.Repeat([]byte{0x42}, 32)
+	codec, err := NewAESGCMCodec(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := NewFS("ns").WithCodec(codec)
+	if err := fs.MkdirAll(""); err != nil {
+		t.Fatal(err)
+	}
+
+	data := bytes.Repeat([]byte("hello world, "), 100000)
+	if _, err := fs.CreateFromReader("f", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := fs.OpenChunked("f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("round trip mismatch: got %d bytes, want %d", len(got), len(data))
+	}
+}
+
+// TestStoreChunkDedupsAcrossNonDeterministicCodec guards the fix for
+// chunking-before-encoding: identical chunk content must dedup to the same
+// object even though AES-GCM reseals it with a fresh random nonce every
+// time, which would defeat dedup if chunk hashes were taken after encoding.
+func TestStoreChunkDedupsAcrossNonDeterministicCodec(t *testing.T) {
+	withTestVolume(t)
+	key := bytes.Repeat([]byte{0x17}, 32)
+	codec, err := NewAESGCMCodec(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := NewFS("ns").WithCodec(codec)
+	if err := fs.MkdirAll(""); err != nil {
+		t.Fatal(err)
+	}
+
+	chunk := bytes.Repeat([]byte("x"), minChunkSize)
+	hash1, err := fs.storeChunk(codec, chunk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash2, err := fs.storeChunk(codec, chunk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hash1 != hash2 {
+		t.Fatalf("identical chunk content produced different hashes: %s vs %s", hash1, hash2)
+	}
+
+	objs, err := fs.ReadDir(filepath.Join(objectsDir, codec.Name(), hash1[:2]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objs) != 1 {
+		t.Fatalf("expected a single deduplicated object, found %d", len(objs))
+	}
+}
+
+// TestStoreChunkDoesNotDedupAcrossCodecs guards against a cross-codec
+// dedup collision: the same plaintext chunk written once with no Codec and
+// once through AES-GCM must land under two distinct objects, even though
+// storeChunk hashes both over the same plaintext. A path keyed on hash
+// alone would let the second write see the first as "already present" and
+// skip storing it, leaving a file whose bytes don't match what its own
+// codec sidecar says to decode them with.
+func TestStoreChunkDoesNotDedupAcrossCodecs(t *testing.T) {
+	withTestVolume(t)
+	key := bytes.Repeat([]byte{0x99}, 32)
+	codec, err := NewAESGCMCodec(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plainFS := NewFS("ns")
+	if err := plainFS.MkdirAll(""); err != nil {
+		t.Fatal(err)
+	}
+	aesFS := plainFS.WithCodec(codec)
+
+	chunk := bytes.Repeat([]byte("y"), minChunkSize)
+	plainHash, err := plainFS.storeChunk(nil, chunk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aesHash, err := aesFS.storeChunk(codec, chunk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plainHash != aesHash {
+		t.Fatalf("plaintext hash should be identical regardless of codec: %s vs %s", plainHash, aesHash)
+	}
+
+	plainData, err := plainFS.readChunk(plainTag, plainHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(plainData, chunk) {
+		t.Fatal("plain-tagged object should hold the untouched plaintext")
+	}
+
+	aesData, err := aesFS.readChunk(codec.Name(), aesHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(aesData, chunk) {
+		t.Fatal("aes-tagged object should hold sealed ciphertext, not plaintext")
+	}
+	decoded, err := ioutil.ReadAll(codec.Decode(bytes.NewReader(aesData)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decoded, chunk) {
+		t.Fatal("aes-tagged object did not decode back to the original chunk")
+	}
+}
+
+// perFileKeyProvider hands out a distinct, deterministic key per file name,
+// standing in for a real KMS-backed KeyProvider in tests.
+type perFileKeyProvider struct{}
+
+func (perFileKeyProvider) Key(name string) ([]byte, error) {
+	key := make([]byte, 32)
+	copy(key, name)
+	return key, nil
+}
+
+// TestWithKeyProviderUsesPerFileKeys guards the KeyProvider wiring: two
+// files written through the same KeyProvider-backed FS must round-trip
+// correctly, but since each resolves a different key from its own name,
+// neither file's ciphertext can be decoded with the other's key.
+func TestWithKeyProviderUsesPerFileKeys(t *testing.T) {
+	withTestVolume(t)
+	fs := NewFS("ns").WithKeyProvider(perFileKeyProvider{})
+	if err := fs.MkdirAll(""); err != nil {
+		t.Fatal(err)
+	}
+
+	dataA := bytes.Repeat([]byte("a"), minChunkSize)
+	dataB := bytes.Repeat([]byte("b"), minChunkSize)
+	if _, err := fs.CreateFromReader("fileA", bytes.NewReader(dataA)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.CreateFromReader("fileB", bytes.NewReader(dataB)); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, want := range map[string][]byte{"fileA": dataA, "fileB": dataB} {
+		r, err := fs.OpenChunked(name)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		got, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("%s: round trip mismatch", name)
+		}
+	}
+
+	manifestA, err := fs.readManifest("fileA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyB, err := (perFileKeyProvider{}).Key("fileB")
+	if err != nil {
+		t.Fatal(err)
+	}
+	codecB, err := NewAESGCMCodec(keyB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealedA, err := fs.readChunk(aesCodecName, manifestA.Chunks[0].Hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(codecB.Decode(bytes.NewReader(sealedA))); err == nil {
+		t.Fatal("fileA's chunk should not decode under fileB's key")
+	}
+}
+
+// TestWithersComposeWithoutDroppingFields guards against WithCodec and
+// WithKeyProvider clobbering each other or WithCache: chaining them in
+// either order must leave all three settings in effect, not just the one
+// the last call in the chain happened to set.
+func TestWithersComposeWithoutDroppingFields(t *testing.T) {
+	codec, err := NewAESGCMCodec(bytes.Repeat([]byte{0x01}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	kp := perFileKeyProvider{}
+
+	base := NewFS("ns")
+	cached, err := base.WithCache(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	withCacheThenCodec := cached.WithCodec(codec)
+	if withCacheThenCodec.cache == nil {
+		t.Fatal("WithCodec dropped the cache carried in from WithCache")
+	}
+	if withCacheThenCodec.codec != codec {
+		t.Fatal("WithCodec did not set its own codec")
+	}
+
+	withKPThenCodec := cached.WithKeyProvider(kp).WithCodec(codec)
+	if withKPThenCodec.cache == nil {
+		t.Fatal("WithCodec dropped the cache carried in from WithCache")
+	}
+	if withKPThenCodec.keyProvider == nil {
+		t.Fatal("WithCodec dropped the keyProvider set by WithKeyProvider earlier in the chain")
+	}
+	if withKPThenCodec.codec != codec {
+		t.Fatal("WithCodec did not set its own codec")
+	}
+
+	withCodecThenKP := cached.WithCodec(codec).WithKeyProvider(kp)
+	if withCodecThenKP.cache == nil {
+		t.Fatal("WithKeyProvider dropped the cache carried in from WithCache")
+	}
+	if withCodecThenKP.codec != codec {
+		t.Fatal("WithKeyProvider dropped the codec set earlier in the chain")
+	}
+	if withCodecThenKP.keyProvider == nil {
+		t.Fatal("WithKeyProvider did not set its own keyProvider")
+	}
+}
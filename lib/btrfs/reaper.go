@@ -0,0 +1,187 @@
+package btrfs
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+// reapActive is 1 while StartReaper's loop is running. startChild checks it
+// to decide whether to hand a child's wait off to the shared reaper or
+// leave it to a plain cmd.Wait().
+var reapActive int32
+
+var reapWaiters sync.Map // pid(int) -> chan syscall.WaitStatus
+
+var (
+	reapedClean    int64
+	reapedAbnormal int64
+)
+
+// ReapCallback runs once for a reaped child, after its exit status is
+// known. waitChild records exit metrics for every child itself; of
+// RunStderr/CallCont/Recv, only Recv passes a ReapCallback, which on an
+// abnormal `btrfs receive` exit cleans up the subvolume it was writing
+// into so a crashed receive can't wedge the pod holding its lock.
+type ReapCallback func(pid int, ws syscall.WaitStatus)
+
+// StartReaper installs a SIGCHLD handler and reaps children started via
+// startChild in the background until ctx is done. Without it, a worker
+// that panics or is killed mid-`btrfs receive` leaves a zombie process
+// holding the subvolume it was writing to, which can wedge the whole pod.
+// RunStderr, CallCont, and Recv start their child with startChild instead
+// of calling cmd.Start()+cmd.Wait() directly, so whichever goroutine
+// happens to be running when the child exits doesn't matter. Children
+// started elsewhere in the process (outside this package) are never
+// touched -- reapAll only ever Wait4s pids startChild registered.
+func StartReaper(ctx context.Context) {
+	atomic.StoreInt32(&reapActive, 1)
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGCHLD)
+	go func() {
+		defer signal.Stop(sigs)
+		defer atomic.StoreInt32(&reapActive, 0)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-sigs:
+				reapAll()
+			}
+		}
+	}()
+}
+
+// startMu is held across c.Start() and the subsequent reapWaiters.Store so
+// that reapAll (which only ever looks at pids already in reapWaiters) can
+// never observe a child between it exiting and its waiter being
+// registered. Without this, a child that exits before startChild's
+// reapWaiters.Store runs would have its SIGCHLD silently dropped and
+// waitChild would block forever.
+var startMu sync.Mutex
+
+// reapAll Wait4s, with WNOHANG, only the pids this package has registered
+// in reapWaiters -- never a catch-all Wait4(-1, ...), which would also reap
+// children started elsewhere in the same binary (e.g. a plain exec.Cmd
+// whose caller expects to reap it itself via cmd.Wait()) out from under
+// them.
+func reapAll() {
+	startMu.Lock()
+	defer startMu.Unlock()
+	var pids []int
+	reapWaiters.Range(func(key, _ interface{}) bool {
+		pids = append(pids, key.(int))
+		return true
+	})
+	for _, pid := range pids {
+		var ws syscall.WaitStatus
+		var got int
+		var err error
+		for {
+			got, err = syscall.Wait4(pid, &ws, syscall.WNOHANG, nil)
+			if err == syscall.EINTR {
+				continue
+			}
+			break
+		}
+		if err != nil {
+			if err != syscall.ECHILD {
+				log.Println("btrfs: reaper Wait4 error for pid", pid, ":", err)
+			}
+			continue
+		}
+		if got != pid {
+			continue // not exited yet (got == 0)
+		}
+		if v, ok := reapWaiters.Load(pid); ok {
+			reapWaiters.Delete(pid)
+			v.(chan syscall.WaitStatus) <- ws
+		}
+	}
+}
+
+func reaperActive() bool {
+	return atomic.LoadInt32(&reapActive) == 1
+}
+
+func recordReap(ws syscall.WaitStatus) {
+	if ws.Exited() && ws.ExitStatus() == 0 {
+		atomic.AddInt64(&reapedClean, 1)
+	} else {
+		atomic.AddInt64(&reapedAbnormal, 1)
+	}
+}
+
+// ReapStats returns how many child processes have exited cleanly vs
+// abnormally, for a metrics exporter to report.
+func ReapStats() (clean, abnormal int64) {
+	return atomic.LoadInt64(&reapedClean), atomic.LoadInt64(&reapedAbnormal)
+}
+
+// startChild starts c and, if the reaper is running, registers it with
+// reapAll under startMu so the two can never interleave -- c.Start() and
+// the reapWaiters.Store that makes c visible to the reaper happen as one
+// atomic step. If no reaper is running it returns a nil channel, and
+// waitChild falls back to a plain c.Wait().
+func startChild(c *exec.Cmd) (chan syscall.WaitStatus, error) {
+	startMu.Lock()
+	defer startMu.Unlock()
+	if err := c.Start(); err != nil {
+		return nil, err
+	}
+	if !reaperActive() {
+		return nil, nil
+	}
+	ch := make(chan syscall.WaitStatus, 1)
+	reapWaiters.Store(c.Process.Pid, ch)
+	return ch, nil
+}
+
+// ExitError reports a child that exited with a non-zero status or was
+// killed by a signal. waitChild always returns this type for an abnormal
+// exit, whether or not the reaper handled the wait, so callers can
+// errors.As for it without the result depending on process-wide state.
+type ExitError struct {
+	Path string
+	Ws   syscall.WaitStatus
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("%s: exited abnormally (%v)", e.Path, e.Ws)
+}
+
+// waitChild waits for c to exit using the channel startChild returned (or
+// c.Wait() if ch is nil, i.e. no reaper is running), then calls hook, if
+// any, with the resulting status.
+func waitChild(c *exec.Cmd, ch chan syscall.WaitStatus, hook ReapCallback) error {
+	var ws syscall.WaitStatus
+	if ch == nil {
+		waitErr := c.Wait()
+		ps := c.ProcessState
+		if ps == nil {
+			return waitErr
+		}
+		var ok bool
+		ws, ok = ps.Sys().(syscall.WaitStatus)
+		if !ok {
+			return waitErr
+		}
+	} else {
+		ws = <-ch
+	}
+
+	recordReap(ws)
+	if hook != nil {
+		hook(c.Process.Pid, ws)
+	}
+	if ws.Exited() && ws.ExitStatus() == 0 {
+		return nil
+	}
+	return &ExitError{Path: c.Path, Ws: ws}
+}
@@ -0,0 +1,60 @@
+package btrfs
+
+import (
+	"context"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+// TestRunStderrReapsUnderReaper exercises the reaper's fast-exit path: a
+// child that's already gone by the time SIGCHLD is handled must still have
+// its exit status delivered to waitChild, not dropped by reapAll or lost to
+// the Start/register race startMu closes.
+func TestRunStderrReapsUnderReaper(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	StartReaper(ctx)
+	defer func() {
+		cancel()
+		time.Sleep(10 * time.Millisecond) // let the reaper goroutine exit
+	}()
+
+	for i := 0; i < 50; i++ {
+		if err := RunStderr(exec.Command("true")); err != nil {
+			t.Fatalf("run %d: %v", i, err)
+		}
+	}
+}
+
+// TestRunStderrAbnormalExit checks that an abnormal exit surfaces as an
+// *ExitError under the reaper, matching the no-reaper path.
+func TestRunStderrAbnormalExit(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	StartReaper(ctx)
+	defer func() {
+		cancel()
+		time.Sleep(10 * time.Millisecond)
+	}()
+
+	err := RunStderr(exec.Command("false"))
+	if err == nil {
+		t.Fatal("expected an error from a non-zero exit")
+	}
+	if _, ok := err.(*ExitError); !ok {
+		t.Fatalf("expected *ExitError, got %T: %v", err, err)
+	}
+}
+
+// TestRunStderrAbnormalExitNoReaper checks the same without a reaper
+// running, so callers get a consistent error type either way.
+func TestRunStderrAbnormalExitNoReaper(t *testing.T) {
+	err := RunStderr(exec.Command("false"))
+	if err == nil {
+		t.Fatal("expected an error from a non-zero exit")
+	}
+	if _, ok := err.(*ExitError); !ok {
+		t.Fatalf("expected *ExitError, got %T: %v", err, err)
+	}
+}
@@ -0,0 +1,83 @@
+package btrfsreplication
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// echoServer is the minimal BtrfsReplicationServer this test needs: it acks
+// every frame it receives and returns a fixed Resume offset, so the test can
+// focus on proving the generated client/server plumbing actually speaks
+// gRPC rather than exercising btrfsreplication's own Server logic.
+type echoServer struct{}
+
+func (echoServer) Send(stream BtrfsReplication_SendServer) error {
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := stream.Send(&Ack{Offset: req.Offset + int64(len(req.Payload))}); err != nil {
+			return err
+		}
+	}
+}
+
+func (echoServer) Resume(ctx context.Context, req *ResumeRequest) (*ResumeResponse, error) {
+	return &ResumeResponse{Offset: 42}, nil
+}
+
+// TestServiceRegistersAndServesOverRealGRPC drives RegisterBtrfsReplicationServer
+// and NewBtrfsReplicationClient over an in-memory grpc.Server/grpc.ClientConn,
+// proving this is an actual gRPC service (not just a package of types
+// resembling one): registration, the Send client-stream/server-stream RPC,
+// and the unary Resume RPC all round-trip over the real grpc wire protocol.
+func TestServiceRegistersAndServesOverRealGRPC(t *testing.T) {
+	lis := bufconn.Listen(1024 * 1024)
+	s := grpc.NewServer()
+	RegisterBtrfsReplicationServer(s, echoServer{})
+	go s.Serve(lis)
+	defer s.Stop()
+
+	conn, err := grpc.Dial("bufnet", grpc.WithInsecure(), grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+		return lis.Dial()
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	client := NewBtrfsReplicationClient(conn)
+
+	resp, err := client.Resume(context.Background(), &ResumeRequest{SrcCommit: "a", DstCommit: "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Offset != 42 {
+		t.Fatalf("got offset %d, want 42", resp.Offset)
+	}
+
+	stream, err := client.Send(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.Send(&SendRequest{Offset: 0, Payload: []byte("hello")}); err != nil {
+		t.Fatal(err)
+	}
+	ack, err := stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ack.Offset != 5 {
+		t.Fatalf("got ack offset %d, want 5", ack.Offset)
+	}
+	stream.CloseSend()
+}
@@ -0,0 +1,207 @@
+// Package btrfsreplication implements the BtrfsReplication gRPC service
+// defined in src/client/btrfsreplication/btrfsreplication.proto: it streams
+// a btrfs send/receive between two Pachyderm workers with per-frame
+// CRC32C checks, ACK-based flow control, and a Resume RPC so an interrupted
+// transfer doesn't have to restart from the parent snapshot.
+package btrfsreplication
+
+import (
+	"context"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"path"
+
+	etcd "github.com/coreos/etcd/clientv3"
+	"google.golang.org/grpc"
+
+	"github.com/pachyderm/pachyderm/lib/btrfs"
+	"github.com/pachyderm/pachyderm/src/client/btrfsreplication"
+	col "github.com/pachyderm/pachyderm/src/server/pkg/collection"
+)
+
+const offsetsPrefix = "/btrfs-replication-offsets"
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// SendRequest is one frame of a btrfs send stream, as defined by the
+// SendRequest message in btrfsreplication.proto.
+type SendRequest = btrfsreplication.SendRequest
+
+// Ack acknowledges that a SendRequest's payload has been durably written,
+// as defined by the Ack message in btrfsreplication.proto.
+type Ack = btrfsreplication.Ack
+
+// ResumeRequest asks for the last acknowledged offset of a transfer, as
+// defined by the ResumeRequest message in btrfsreplication.proto.
+type ResumeRequest = btrfsreplication.ResumeRequest
+
+// ResumeResponse reports the last acknowledged offset of a transfer, as
+// defined by the ResumeResponse message in btrfsreplication.proto.
+type ResumeResponse = btrfsreplication.ResumeResponse
+
+// SendStream is the generated BtrfsReplication_SendServer interface this
+// package's Send method is called with: receive framed payloads and ack the
+// ones that land.
+type SendStream = btrfsreplication.BtrfsReplication_SendServer
+
+// SendClientStream is the generated BtrfsReplication_SendClient interface
+// this package's SendFromFS drives: send framed payloads and read back the
+// acks for them.
+type SendClientStream = btrfsreplication.BtrfsReplication_SendClient
+
+// offsetState is the etcd-persisted checkpoint for one (srcCommit,
+// dstCommit) transfer.
+type offsetState struct {
+	Offset int64
+}
+
+// Server implements the BtrfsReplication service on top of a *btrfs.FS.
+type Server struct {
+	fs         *btrfs.FS
+	etcdClient *etcd.Client
+	offsets    col.Collection
+}
+
+var _ btrfsreplication.BtrfsReplicationServer = (*Server)(nil)
+
+// NewServer returns a Server that replicates through fs, persisting resume
+// offsets in etcd under etcdPrefix.
+func NewServer(fs *btrfs.FS, etcdClient *etcd.Client, etcdPrefix string) *Server {
+	return &Server{
+		fs:         fs,
+		etcdClient: etcdClient,
+		offsets:    col.NewCollection(etcdClient, path.Join(etcdPrefix, offsetsPrefix), nil, &offsetState{}, nil, nil),
+	}
+}
+
+// Register registers s with grpcServer, so it serves the RPCs the
+// BtrfsReplication service defines in btrfsreplication.proto.
+func (s *Server) Register(grpcServer *grpc.Server) {
+	btrfsreplication.RegisterBtrfsReplicationServer(grpcServer, s)
+}
+
+func offsetKey(srcCommit, dstCommit string) string {
+	return path.Join(srcCommit, dstCommit)
+}
+
+func (s *Server) lastAckedOffset(ctx context.Context, srcCommit, dstCommit string) (int64, error) {
+	state := &offsetState{}
+	if err := s.offsets.ReadOnly(ctx).Get(offsetKey(srcCommit, dstCommit), state); err != nil {
+		if col.IsErrNotFound(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	return state.Offset, nil
+}
+
+func (s *Server) ack(ctx context.Context, srcCommit, dstCommit string, offset int64) error {
+	_, err := col.NewSTM(ctx, s.etcdClient, func(stm col.STM) error {
+		offsetsRW := s.offsets.ReadWrite(stm)
+		return offsetsRW.Put(offsetKey(srcCommit, dstCommit), &offsetState{Offset: offset})
+	})
+	return err
+}
+
+// Send implements the server side of the Send RPC: it reads framed payloads
+// off stream, verifies each against its CRC32C, writes it to a live `btrfs
+// receive` for the transfer's destination volume, and acks every frame it
+// durably commits -- giving the client flow control so it can't run far
+// ahead of a slow receive.
+func (s *Server) Send(stream SendStream) error {
+	first, err := stream.Recv()
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	srcCommit, dstCommit := first.SrcCommit, first.DstCommit
+
+	pr, pw := io.Pipe()
+	recvErr := make(chan error, 1)
+	go func() { recvErr <- s.fs.Recv(dstCommit, pr) }()
+
+	writeFrame := func(req *SendRequest) error {
+		if crc := crc32.Checksum(req.Payload, crc32cTable); crc != req.Crc32C {
+			return fmt.Errorf("btrfsreplication: frame at offset %d from %s failed CRC32C check: got %x, want %x",
+				req.Offset, req.SrcCommit, crc, req.Crc32C)
+		}
+		if _, err := pw.Write(req.Payload); err != nil {
+			return err
+		}
+		offset := req.Offset + int64(len(req.Payload))
+		if err := s.ack(stream.Context(), srcCommit, dstCommit, offset); err != nil {
+			return err
+		}
+		return stream.Send(&Ack{Offset: offset})
+	}
+
+	if err := writeFrame(first); err != nil {
+		pw.CloseWithError(err)
+		<-recvErr
+		return err
+	}
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			pw.Close()
+			return <-recvErr
+		}
+		if err != nil {
+			pw.CloseWithError(err)
+			<-recvErr
+			return err
+		}
+		if err := writeFrame(req); err != nil {
+			pw.CloseWithError(err)
+			<-recvErr
+			return err
+		}
+	}
+}
+
+// Resume implements the Resume RPC: it reports the last offset this server
+// has acknowledged for (req.SrcCommit, req.DstCommit), so the client can
+// regenerate the btrfs send stream for that pair and skip everything up to
+// that point instead of restarting the transfer from scratch.
+func (s *Server) Resume(ctx context.Context, req *ResumeRequest) (*ResumeResponse, error) {
+	offset, err := s.lastAckedOffset(ctx, req.SrcCommit, req.DstCommit)
+	if err != nil {
+		return nil, err
+	}
+	return &ResumeResponse{Offset: offset}, nil
+}
+
+// SendFromFS drives the client side of the Send RPC for repo: it runs
+// FS.Send (or FS.SendBase, if from is empty) and streams the result to
+// stream as framed SendRequests, using progress to surface how much has
+// been acknowledged so far.
+func SendFromFS(fs *btrfs.FS, stream SendClientStream, srcCommit, dstCommit, from string, fromOffset int64, progress btrfs.ProgressReporter) error {
+	cont := func(data io.ReadCloser) error {
+		return btrfs.ChunkStream(data, fromOffset, func(offset int64, payload []byte, crc32c uint32) error {
+			if err := stream.Send(&SendRequest{
+				SrcCommit: srcCommit,
+				DstCommit: dstCommit,
+				Offset:    offset,
+				Payload:   payload,
+				Crc32C:    crc32c,
+			}); err != nil {
+				return err
+			}
+			ack, err := stream.Recv()
+			if err != nil {
+				return err
+			}
+			if progress != nil {
+				progress(ack.Offset)
+			}
+			return nil
+		})
+	}
+	if from == "" {
+		return fs.SendBase(srcCommit, cont)
+	}
+	return fs.Send(from, srcCommit, cont)
+}
@@ -0,0 +1,393 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"path"
+	"time"
+
+	etcd "github.com/coreos/etcd/clientv3"
+
+	"github.com/pachyderm/pachyderm/src/client"
+	"github.com/pachyderm/pachyderm/src/client/pps"
+	col "github.com/pachyderm/pachyderm/src/server/pkg/collection"
+	"github.com/pachyderm/pachyderm/src/server/pkg/ppsdb"
+)
+
+const (
+	chunksPrefix   = "/chunks"
+	progressPrefix = "/progress"
+
+	// chunkLeaseTTL bounds how long a chunk stays claimed without its owner
+	// renewing: work-stealing only considers a chunk whose lease has
+	// expired, so a live worker can never have its in-flight chunk stolen
+	// out from under it. chunkLeaseRenew is how often acquireDatums
+	// refreshes the lease of the chunk it's actively processing.
+	chunkLeaseTTL   = 30 * time.Second
+	chunkLeaseRenew = chunkLeaseTTL / 3
+)
+
+// APIServer implements the worker side of a pipeline: it claims chunks of
+// datums from etcd and hands them off to be processed.
+type APIServer struct {
+	pachClient *client.APIClient
+	etcdClient *etcd.Client
+	etcdPrefix string
+
+	logMsgTemplate pps.LogMessage
+
+	jobs      col.Collection
+	pipelines col.Collection
+	chunks    col.Collection
+	progress  *ProgressStore
+}
+
+// NewAPIServer constructs an APIServer for a worker pod.
+func NewAPIServer(pachClient *client.APIClient, etcdClient *etcd.Client, etcdPrefix string, logMsgTemplate pps.LogMessage) *APIServer {
+	return &APIServer{
+		pachClient:     pachClient,
+		etcdClient:     etcdClient,
+		etcdPrefix:     etcdPrefix,
+		logMsgTemplate: logMsgTemplate,
+		jobs:           ppsdb.Jobs(etcdClient, etcdPrefix),
+		pipelines:      ppsdb.Pipelines(etcdClient, etcdPrefix),
+		chunks:         col.NewCollection(etcdClient, path.Join(etcdPrefix, chunksPrefix), nil, &Chunks{}, nil, nil),
+		progress:       newProgressStore(etcdClient, etcdPrefix),
+	}
+}
+
+// Chunks is the claim state of a job's chunk boundaries, stored in etcd
+// under chunksPrefix keyed by job ID. Chunks is a strictly increasing list
+// of upper bounds, so chunk i covers the datum range
+// (prevBound(i), Chunks[i]]. Owner, Progress, and Lease are parallel
+// arrays: Owner[i] is the worker ID that currently holds chunk i (empty if
+// unclaimed), Progress[i] is the last datum index known to be fully
+// processed within it, and Lease[i] is the UnixNano time at which Owner[i]'s
+// claim expires if not renewed -- work-stealing only takes a chunk whose
+// lease has already expired, so it never steals from a worker that's still
+// actively processing.
+type Chunks struct {
+	Chunks   []int64
+	Owner    []string
+	Progress []int64
+	Lease    []int64
+}
+
+func prevBound(chunks *Chunks, idx int) int64 {
+	if idx == 0 {
+		return 0
+	}
+	return chunks.Chunks[idx-1]
+}
+
+// normalize grows Owner/Progress/Lease to match Chunks after a Create or a
+// racing STM update appended new chunks, leaving new entries unclaimed,
+// unprocessed, and with an already-expired lease.
+func normalize(chunks *Chunks) {
+	for i := len(chunks.Owner); i < len(chunks.Chunks); i++ {
+		chunks.Owner = append(chunks.Owner, "")
+	}
+	for i := len(chunks.Progress); i < len(chunks.Chunks); i++ {
+		chunks.Progress = append(chunks.Progress, prevBound(chunks, i))
+	}
+	for i := len(chunks.Lease); i < len(chunks.Chunks); i++ {
+		chunks.Lease = append(chunks.Lease, 0)
+	}
+}
+
+// claimIndex picks the next chunk index to work on: an unclaimed,
+// incomplete chunk if one exists, otherwise the tail of the in-flight
+// chunk, among those whose lease has expired, with the most datums still
+// remaining (work-stealing), which addresses long-tail latency from chunks
+// with skewed per-datum runtimes. A chunk whose owner is still renewing its
+// lease is never a candidate, so work-stealing can't collide with a worker
+// that's actively processing it.
+func claimIndex(chunks *Chunks, now int64) (idx int, ok bool) {
+	for i, high := range chunks.Chunks {
+		if chunks.Progress[i] >= high {
+			continue
+		}
+		if chunks.Owner[i] == "" {
+			return i, true
+		}
+	}
+	best, bestRemaining := -1, int64(0)
+	for i, high := range chunks.Chunks {
+		if chunks.Progress[i] >= high {
+			continue
+		}
+		if chunks.Lease[i] > now {
+			continue // owner's lease hasn't expired; still alive
+		}
+		remaining := high - chunks.Progress[i]
+		if best == -1 || remaining > bestRemaining {
+			best, bestRemaining = i, remaining
+		}
+	}
+	if best == -1 {
+		return 0, false
+	}
+	return best, true
+}
+
+func indexOf(chunks *Chunks, high int64) int {
+	for i, h := range chunks.Chunks {
+		if h == high {
+			return i
+		}
+	}
+	return -1
+}
+
+// ChunkProgress is the checkpoint persisted for one (jobID, chunkHigh) pair
+// so that a worker resuming a chunk after a kill or preemption can skip the
+// datums that already completed. InputHash identifies the input a
+// checkpoint's datums were processed against, so a checkpoint left over
+// from a job whose input has since changed is never mistaken for progress
+// against the current input. Epoch counts the checkpoints written for this
+// (jobID, chunkHigh): acquireDatums captures the Epoch it last observed
+// before it starts processing and passes it back to Checkpoint, so a
+// checkpoint written by a worker that's since been stolen from (and whose
+// Epoch has therefore moved on without it) is rejected instead of
+// clobbering the stealing worker's progress.
+type ChunkProgress struct {
+	LastCompletedDatum int64
+	InputHash          string
+	Epoch              int64
+}
+
+// ProgressStore persists per-chunk datum checkpoints in etcd, keyed by
+// (jobID, chunkHigh). chunkHigh uniquely identifies a chunk within a job
+// because Chunks.Chunks is strictly increasing.
+type ProgressStore struct {
+	col        col.Collection
+	etcdClient *etcd.Client
+}
+
+func newProgressStore(etcdClient *etcd.Client, etcdPrefix string) *ProgressStore {
+	return &ProgressStore{
+		col:        col.NewCollection(etcdClient, path.Join(etcdPrefix, progressPrefix), nil, &ChunkProgress{}, nil, nil),
+		etcdClient: etcdClient,
+	}
+}
+
+func progressKey(jobID string, chunkHigh int64) string {
+	return path.Join(jobID, fmt.Sprintf("%d", chunkHigh))
+}
+
+// Get returns the checkpoint for (jobID, chunkHigh), or a zero-value
+// ChunkProgress if none has been recorded yet. If the one recorded was
+// written against a different inputHash -- the input it checkpointed
+// progress against no longer exists, so that progress doesn't apply here --
+// it returns a ChunkProgress with no completed datums that carries only the
+// stored Epoch, so the caller's next Checkpoint isn't rejected as stale.
+func (p *ProgressStore) Get(ctx context.Context, jobID string, chunkHigh int64, inputHash string) (*ChunkProgress, error) {
+	progress := &ChunkProgress{}
+	if err := p.col.ReadOnly(ctx).Get(progressKey(jobID, chunkHigh), progress); err != nil {
+		if col.IsErrNotFound(err) {
+			return &ChunkProgress{}, nil
+		}
+		return nil, err
+	}
+	if progress.InputHash != inputHash {
+		return &ChunkProgress{Epoch: progress.Epoch}, nil
+	}
+	return progress, nil
+}
+
+// Checkpoint records that every datum up to and including lastCompletedDatum
+// has been processed for (jobID, chunkHigh) against inputHash, as long as
+// the stored Epoch is no newer than epoch: epoch is the Epoch the caller
+// last observed (from Get, or from its own prior Checkpoint call), and a
+// newer stored Epoch means this chunk was stolen and reclaimed since then,
+// so the caller's progress is no longer authoritative and the write is
+// silently dropped rather than clobbering the new owner's checkpoint.
+func (p *ProgressStore) Checkpoint(ctx context.Context, jobID string, chunkHigh, lastCompletedDatum int64, inputHash string, epoch int64) error {
+	_, err := col.NewSTM(ctx, p.etcdClient, func(stm col.STM) error {
+		progress := &ChunkProgress{}
+		progressRW := p.col.ReadWrite(stm)
+		if err := progressRW.Get(progressKey(jobID, chunkHigh), progress); err != nil && !col.IsErrNotFound(err) {
+			return err
+		}
+		if progress.Epoch > epoch {
+			return nil
+		}
+		if progress.InputHash == inputHash && lastCompletedDatum <= progress.LastCompletedDatum {
+			return nil
+		}
+		progress.LastCompletedDatum = lastCompletedDatum
+		progress.InputHash = inputHash
+		progress.Epoch = epoch + 1
+		return progressRW.Put(progressKey(jobID, chunkHigh), progress)
+	})
+	return err
+}
+
+// processResult is what a chunk's processing callback reports back to
+// acquireDatums once it returns, successfully or not.
+type processResult struct {
+	// LastDatum is the last datum index (within the chunk's range) known
+	// to have been fully processed before the callback returned. It's
+	// checkpointed even on error so a subsequent acquire can resume from
+	// it instead of reprocessing the whole chunk.
+	LastDatum int64
+}
+
+func (a *APIServer) workerID() string {
+	return a.logMsgTemplate.WorkerID
+}
+
+// renewLease keeps jobID's chunk at chunkHigh leased to this worker for as
+// long as ctx is alive, bumping its expiry every chunkLeaseRenew so
+// claimIndex's work-stealing never mistakes an active worker for a dead
+// one. It gives up quietly on any renewal error or once another worker
+// already owns the chunk (e.g. this worker's own prior lease already
+// expired and was stolen).
+func (a *APIServer) renewLease(ctx context.Context, jobID string, chunkHigh int64) {
+	ticker := time.NewTicker(chunkLeaseRenew)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := col.NewSTM(ctx, a.etcdClient, func(stm col.STM) error {
+				chunksRW := a.chunks.ReadWrite(stm)
+				stored := &Chunks{}
+				if err := chunksRW.Get(jobID, stored); err != nil {
+					return err
+				}
+				normalize(stored)
+				idx := indexOf(stored, chunkHigh)
+				if idx < 0 || stored.Owner[idx] != a.workerID() {
+					return nil
+				}
+				stored.Lease[idx] = time.Now().Add(chunkLeaseTTL).UnixNano()
+				return chunksRW.Put(jobID, stored)
+			}); err != nil {
+				log.Println("worker: failed to renew chunk lease:", err)
+			}
+		}
+	}
+}
+
+// acquireDatums claims chunks of jobID's datum space one at a time,
+// skipping any datums a prior, killed attempt already checkpointed, and
+// calls process(low, high, checkpoint) for each range it claims. process
+// should call checkpoint(datum) as each datum completes, in increasing
+// order and without overlapping calls, so that a worker killed mid-chunk --
+// one that never returns from process at all -- still leaves behind
+// progress for the next claimant to resume from, rather than only the
+// datum processing happened to reach if process returns cleanly. It returns
+// nil once no chunk is left to claim: every chunk is complete, or every
+// incomplete one is held under a live lease. Once a worker has exhausted unclaimed
+// chunks it starts stealing the tail of whichever in-flight chunk has the
+// most datums left and has gone chunkLeaseTTL without its owner renewing,
+// so no worker sits idle while another grinds through a slow chunk, but an
+// actively processing chunk is never raced. inputHash identifies the input
+// being processed, so a checkpoint left over from a since-changed input is
+// never mistaken for progress against this one.
+func (a *APIServer) acquireDatums(ctx context.Context, jobID string, initial *Chunks, inputHash string, logger *taggedLogger, process func(low, high int64, checkpoint func(datum int64) error) (*processResult, error)) error {
+	for {
+		var low, high, epoch int64
+		var claimed bool
+		_, err := col.NewSTM(ctx, a.etcdClient, func(stm col.STM) error {
+			chunksRW := a.chunks.ReadWrite(stm)
+			stored := &Chunks{}
+			if err := chunksRW.Get(jobID, stored); err != nil {
+				if !col.IsErrNotFound(err) {
+					return err
+				}
+				stored = initial
+			}
+			normalize(stored)
+
+			idx, ok := claimIndex(stored, time.Now().UnixNano())
+			if !ok {
+				return nil
+			}
+			claimed = true
+			high = stored.Chunks[idx]
+			low = stored.Progress[idx]
+
+			checkpoint, err := a.progress.Get(ctx, jobID, high, inputHash)
+			if err != nil {
+				return err
+			}
+			if checkpoint.LastCompletedDatum > low {
+				low = checkpoint.LastCompletedDatum
+			}
+			epoch = checkpoint.Epoch
+
+			stored.Owner[idx] = a.workerID()
+			stored.Progress[idx] = low
+			stored.Lease[idx] = time.Now().Add(chunkLeaseTTL).UnixNano()
+			return chunksRW.Put(jobID, stored)
+		})
+		if err != nil {
+			return err
+		}
+		if !claimed {
+			return nil
+		}
+		if low >= high {
+			continue
+		}
+
+		renewCtx, cancelRenew := context.WithCancel(ctx)
+		go a.renewLease(renewCtx, jobID, high)
+		checkpointFn := func(datum int64) error {
+			if err := a.progress.Checkpoint(ctx, jobID, high, datum, inputHash, epoch); err != nil {
+				return err
+			}
+			epoch++
+			return nil
+		}
+		result, processErr := process(low, high, checkpointFn)
+		cancelRenew()
+		if result != nil && result.LastDatum > low {
+			if err := a.progress.Checkpoint(ctx, jobID, high, result.LastDatum, inputHash, epoch); err != nil {
+				return err
+			}
+		}
+		if processErr != nil {
+			return processErr
+		}
+
+		if _, err := col.NewSTM(ctx, a.etcdClient, func(stm col.STM) error {
+			chunksRW := a.chunks.ReadWrite(stm)
+			stored := &Chunks{}
+			if err := chunksRW.Get(jobID, stored); err != nil {
+				return err
+			}
+			normalize(stored)
+			idx := indexOf(stored, high)
+			if idx < 0 {
+				return nil
+			}
+			stored.Progress[idx] = high
+			return chunksRW.Put(jobID, stored)
+		}); err != nil {
+			return err
+		}
+	}
+}
+
+// taggedLogger writes log lines tagged with the worker's pipeline/job
+// identity, as recorded in logMsgTemplate.
+type taggedLogger struct {
+	template pps.LogMessage
+}
+
+// getMasterLogger returns the logger used for events that apply to the
+// whole job rather than a single datum, such as acquiring chunks.
+func (a *APIServer) getMasterLogger() *taggedLogger {
+	template := a.logMsgTemplate
+	return &taggedLogger{template: template}
+}
+
+func (l *taggedLogger) Logf(format string, args ...interface{}) {
+	l.template.Message = fmt.Sprintf(format, args...)
+	log.Println(l.template.Message)
+}